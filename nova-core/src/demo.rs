@@ -125,7 +125,7 @@ async fn demo_event_system(system: &PluginSystem) -> Result<()> {
     // Spawn background task to handle events
     let event_handler = tokio::spawn(async move {
         let mut event_count = 0;
-        while let Ok(event) = subscription.receiver.recv().await {
+        while let Some(event) = subscription.recv().await {
             event_count += 1;
             info!("Received event #{}: {:?} from {}", event_count, event.event_type, event.source);
             if event_count >= 2 {
@@ -5,12 +5,17 @@ use nova_plugin_api::{
 use nova_ui::NovaApp;
 use std::sync::Arc;
 use tokio::sync::RwLock;
-use tracing::info;
+use tracing::{info, Level};
+use tracing_subscriber::filter::Targets;
+use tracing_subscriber::prelude::*;
 
 #[tokio::main]
 async fn main() -> Result<()> {
     // Initialize tracing
-    tracing_subscriber::fmt::init();
+    tracing_subscriber::registry()
+        .with(tracing_subscriber::fmt::layer())
+        .with(log_filter(log_level_from_args(std::env::args().skip(1))))
+        .init();
     
     info!("Starting NovaPcSuite v{}", env!("CARGO_PKG_VERSION"));
 
@@ -41,6 +46,67 @@ async fn main() -> Result<()> {
     Ok(())
 }
 
+/// Log targets whose level follows -q/-v/-vv: the nova binary, nova_plugin_api,
+/// nova_ui and the bundled plugins
+///
+/// `Targets` matches by prefix, so "nova" alone would already cover the other
+/// nova crates. They are still listed one by one; a new bundled plugin must be
+/// added here or it stays at the dependency level.
+const NOVA_LOG_TARGETS: &[&str] = &["nova", "nova_plugin_api", "nova_ui", "example_plugin"];
+
+/// Map -q/-v/-vv command line flags to a log level
+///
+/// -q/--quiet only keeps warnings and errors and always wins over -v. Every
+/// `v` in a short flag (-v, -vv, -vvv, -v -v) and every --verbose raises the
+/// level one step, from info to debug to trace.
+fn log_level_from_args(args: impl Iterator<Item = String>) -> Level {
+    let mut quiet = false;
+    let mut verbosity = 0;
+
+    for arg in args {
+        match arg.as_str() {
+            "--quiet" => quiet = true,
+            "--verbose" => verbosity += 1,
+            flags if flags.starts_with('-') && !flags.starts_with("--") => {
+                for flag in flags.chars().skip(1) {
+                    match flag {
+                        'q' => quiet = true,
+                        'v' => verbosity += 1,
+                        _ => {}
+                    }
+                }
+            }
+            _ => {}
+        }
+    }
+
+    if quiet {
+        return Level::WARN;
+    }
+
+    match verbosity {
+        0 => Level::INFO,
+        1 => Level::DEBUG,
+        _ => Level::TRACE,
+    }
+}
+
+/// Build a log filter applying `level` to NovaPcSuite targets only
+///
+/// Dependencies such as eframe, wgpu and winit stay at info, or at warn in
+/// quiet mode, so -vv doesn't flood the output with their traces.
+fn log_filter(level: Level) -> Targets {
+    let dependency_level = if level == Level::WARN {
+        Level::WARN
+    } else {
+        Level::INFO
+    };
+
+    Targets::new()
+        .with_default(dependency_level)
+        .with_targets(NOVA_LOG_TARGETS.iter().map(|target| (*target, level)))
+}
+
 /// Core plugin system management
 pub struct PluginSystem {
     pub registry: Arc<PluginRegistry>,
@@ -105,4 +171,57 @@ impl PluginSystem {
         info!("Plugin system shutdown complete");
         Ok(())
     }
-}
\ No newline at end of file
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn level_for(args: &[&str]) -> Level {
+        log_level_from_args(args.iter().map(|arg| arg.to_string()))
+    }
+
+    #[test]
+    fn test_default_log_level() {
+        assert_eq!(level_for(&[]), Level::INFO);
+        assert_eq!(level_for(&["--unrelated", "value"]), Level::INFO);
+    }
+
+    #[test]
+    fn test_quiet_flag() {
+        assert_eq!(level_for(&["-q"]), Level::WARN);
+        assert_eq!(level_for(&["--quiet"]), Level::WARN);
+    }
+
+    #[test]
+    fn test_verbose_flags() {
+        assert_eq!(level_for(&["-v"]), Level::DEBUG);
+        assert_eq!(level_for(&["--verbose"]), Level::DEBUG);
+        assert_eq!(level_for(&["-vv"]), Level::TRACE);
+        assert_eq!(level_for(&["-v", "-v"]), Level::TRACE);
+        assert_eq!(level_for(&["-vvv"]), Level::TRACE);
+    }
+
+    #[test]
+    fn test_log_filter_scopes_level_to_nova_targets() {
+        let filter = log_filter(Level::TRACE);
+        for target in NOVA_LOG_TARGETS {
+            assert!(filter.would_enable(target, &Level::TRACE));
+        }
+        assert!(filter.would_enable("nova_plugin_api::events", &Level::TRACE));
+        assert!(filter.would_enable("tokio::runtime", &Level::INFO));
+        assert!(!filter.would_enable("tokio::runtime", &Level::DEBUG));
+
+        let filter = log_filter(Level::WARN);
+        assert!(!filter.would_enable("nova_ui", &Level::INFO));
+        assert!(!filter.would_enable("tokio::runtime", &Level::INFO));
+    }
+
+    #[test]
+    fn test_quiet_wins_over_verbose() {
+        assert_eq!(level_for(&["-q", "-v"]), Level::WARN);
+        assert_eq!(level_for(&["-v", "-q"]), Level::WARN);
+        assert_eq!(level_for(&["-vv", "--quiet"]), Level::WARN);
+        assert_eq!(level_for(&["-qv"]), Level::WARN);
+    }
+}
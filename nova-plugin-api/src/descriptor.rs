@@ -56,6 +56,10 @@ pub enum PluginCategory {
     Crypto,
     #[serde(rename = "integration")]
     Integration,
+    #[serde(rename = "provider")]
+    Provider,
+    #[serde(rename = "storage")]
+    Storage,
 }
 
 /// Parse plugin descriptor from TOML content
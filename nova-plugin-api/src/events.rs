@@ -1,75 +1,320 @@
 use serde::{Deserialize, Serialize};
-use std::collections::HashMap;
-use std::sync::Arc;
-use tokio::sync::{broadcast, RwLock};
+use std::collections::{HashMap, VecDeque};
+use std::sync::{Arc, Mutex, MutexGuard, PoisonError, RwLock};
+use tokio::sync::Notify;
 use uuid::Uuid;
 
+/// Default number of events buffered per subscriber
+pub const DEFAULT_EVENT_CAPACITY: usize = 1000;
+
+/// Event source used for events published by the application itself
+pub const SYSTEM_EVENT_SOURCE: &str = "system";
+
 /// Event bus for plugin communication
+///
+/// Every subscriber gets its own bounded queue, and receives events in publish
+/// order. What happens when a queue is full is chosen per subscriber through
+/// [`SubscriptionOptions`].
 #[derive(Debug)]
 pub struct EventBus {
-    sender: broadcast::Sender<NovaEvent>,
     subscribers: Arc<RwLock<HashMap<String, PluginEventSubscription>>>,
+    default_capacity: usize,
 }
 
 impl EventBus {
     pub fn new() -> Self {
-        let (sender, _) = broadcast::channel(1000);
+        Self::with_capacity(DEFAULT_EVENT_CAPACITY)
+    }
+
+    /// Create an event bus whose subscribers buffer up to `capacity` events,
+    /// unless they ask for a different size when subscribing
+    pub fn with_capacity(capacity: usize) -> Self {
         Self {
-            sender,
             subscribers: Arc::new(RwLock::new(HashMap::new())),
+            default_capacity: capacity.max(1),
         }
     }
 
-    /// Publish an event to all subscribers
+    /// Publish an event to all subscribers whose filter matches it
+    ///
+    /// Waits for room in the queue of every matching subscriber using
+    /// [`DeliveryPolicy::Block`].
     pub async fn publish(&self, event: NovaEvent) -> anyhow::Result<()> {
-        match self.sender.send(event) {
-            Ok(subscriber_count) => {
-                tracing::debug!("Published event to {} subscribers", subscriber_count);
-                Ok(())
-            }
-            Err(_) => {
-                tracing::warn!("No subscribers for event");
-                Ok(())
-            }
+        let queues: Vec<Arc<SubscriberQueue>> = {
+            let mut subscribers = self
+                .subscribers
+                .write()
+                .unwrap_or_else(PoisonError::into_inner);
+            subscribers.retain(|_, subscription| !subscription.queue.is_detached());
+            subscribers
+                .values()
+                .filter(|subscription| subscription.filter.matches(&event))
+                .map(|subscription| subscription.queue.clone())
+                .collect()
+        };
+
+        if queues.is_empty() {
+            tracing::debug!("No subscribers for {:?} event", event.event_type);
+            return Ok(());
+        }
+
+        for queue in &queues {
+            queue.push(event.clone()).await;
         }
+
+        tracing::debug!("Published event to {} subscribers", queues.len());
+        Ok(())
     }
 
     /// Subscribe to events with a filter
     pub async fn subscribe(&self, plugin_id: String, filter: EventFilter) -> EventSubscription {
-        let receiver = self.sender.subscribe();
+        self.subscribe_with(plugin_id, filter, SubscriptionOptions::default())
+            .await
+    }
+
+    /// Subscribe to events with a filter and custom delivery options
+    pub async fn subscribe_with(
+        &self,
+        plugin_id: String,
+        filter: EventFilter,
+        options: SubscriptionOptions,
+    ) -> EventSubscription {
         let subscription_id = Uuid::new_v4().to_string();
-        
+        let queue = Arc::new(SubscriberQueue::new(
+            options.capacity.unwrap_or(self.default_capacity),
+            options,
+        ));
+
         let subscription = PluginEventSubscription {
             plugin_id: plugin_id.clone(),
             filter,
             subscription_id: subscription_id.clone(),
+            queue: queue.clone(),
         };
 
-        let mut subscribers = self.subscribers.write().await;
+        let mut subscribers = self
+            .subscribers
+            .write()
+            .unwrap_or_else(PoisonError::into_inner);
         subscribers.insert(subscription_id.clone(), subscription);
 
         EventSubscription {
             id: subscription_id,
-            receiver,
+            queue,
         }
     }
 
     /// Unsubscribe from events
+    ///
+    /// The subscription still yields the events queued so far, then ends.
     pub async fn unsubscribe(&self, subscription_id: &str) {
-        let mut subscribers = self.subscribers.write().await;
-        subscribers.remove(subscription_id);
+        let mut subscribers = self
+            .subscribers
+            .write()
+            .unwrap_or_else(PoisonError::into_inner);
+        if let Some(subscription) = subscribers.remove(subscription_id) {
+            subscription.queue.close();
+        }
     }
 
     /// Get subscriber count
     pub fn subscriber_count(&self) -> usize {
-        self.sender.receiver_count()
+        let subscribers = self
+            .subscribers
+            .read()
+            .unwrap_or_else(PoisonError::into_inner);
+        subscribers
+            .values()
+            .filter(|subscription| !subscription.queue.is_detached())
+            .count()
     }
 }
 
+impl Default for EventBus {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl Drop for EventBus {
+    fn drop(&mut self) {
+        let subscribers = self
+            .subscribers
+            .read()
+            .unwrap_or_else(PoisonError::into_inner);
+        for subscription in subscribers.values() {
+            subscription.queue.close();
+        }
+    }
+}
+
+/// What a subscriber queue does when a new event arrives while it is full
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum DeliveryPolicy {
+    /// Drop the oldest queued event, so publishers are never slowed down
+    #[default]
+    DropOldest,
+    /// Make `publish` wait until the subscriber has received an event
+    ///
+    /// A subscriber using this policy must keep receiving, otherwise it stalls
+    /// every publisher.
+    Block,
+}
+
+/// Delivery options of a single subscription
+#[derive(Debug, Clone, Default)]
+pub struct SubscriptionOptions {
+    /// Queue size, or the event bus default when `None`
+    pub capacity: Option<usize>,
+    /// Behavior when the queue is full
+    pub policy: DeliveryPolicy,
+    /// Event types for which only the most recent queued event is kept, for
+    /// high-frequency updates such as progress
+    pub coalesce: Vec<EventType>,
+}
+
 /// Event subscription handle
+///
+/// Only events matching the subscription filter are queued, so unrelated
+/// traffic can't push wanted events out of a full queue.
 pub struct EventSubscription {
     pub id: String,
-    pub receiver: broadcast::Receiver<NovaEvent>,
+    queue: Arc<SubscriberQueue>,
+}
+
+impl EventSubscription {
+    /// Receive the next event matching the subscription filter
+    ///
+    /// Returns `None` once the event bus has been dropped or the subscription
+    /// was unsubscribed, and all queued events have been received.
+    pub async fn recv(&mut self) -> Option<NovaEvent> {
+        self.queue.pop().await
+    }
+
+    /// Number of matching events dropped because this subscriber's queue was full
+    pub fn dropped_count(&self) -> u64 {
+        self.queue.lock().dropped
+    }
+}
+
+impl Drop for EventSubscription {
+    fn drop(&mut self) {
+        self.queue.detach();
+    }
+}
+
+/// Bounded event queue of a single subscriber
+#[derive(Debug)]
+struct SubscriberQueue {
+    state: Mutex<QueueState>,
+    capacity: usize,
+    options: SubscriptionOptions,
+    readable: Notify,
+    writable: Notify,
+}
+
+#[derive(Debug, Default)]
+struct QueueState {
+    events: VecDeque<NovaEvent>,
+    dropped: u64,
+    /// No more events will be published to this queue
+    closed: bool,
+    /// The subscription handle was dropped
+    detached: bool,
+}
+
+impl SubscriberQueue {
+    fn new(capacity: usize, options: SubscriptionOptions) -> Self {
+        Self {
+            state: Mutex::new(QueueState::default()),
+            capacity: capacity.max(1),
+            options,
+            readable: Notify::new(),
+            writable: Notify::new(),
+        }
+    }
+
+    fn lock(&self) -> MutexGuard<'_, QueueState> {
+        self.state.lock().unwrap_or_else(PoisonError::into_inner)
+    }
+
+    fn coalesces(&self, event: &NovaEvent) -> bool {
+        self.options
+            .coalesce
+            .iter()
+            .any(|t| *t == EventType::All || *t == event.event_type)
+    }
+
+    async fn push(&self, event: NovaEvent) {
+        let coalesce = self.coalesces(&event);
+
+        loop {
+            let writable = self.writable.notified();
+            {
+                let mut state = self.lock();
+                if state.closed || state.detached {
+                    return;
+                }
+
+                if coalesce {
+                    if let Some(index) = state
+                        .events
+                        .iter()
+                        .position(|queued| queued.event_type == event.event_type)
+                    {
+                        state.events.remove(index);
+                    }
+                }
+
+                let full = state.events.len() >= self.capacity;
+                if full && self.options.policy == DeliveryPolicy::DropOldest {
+                    state.events.pop_front();
+                    state.dropped += 1;
+                }
+
+                if !full || self.options.policy == DeliveryPolicy::DropOldest {
+                    state.events.push_back(event);
+                    drop(state);
+                    self.readable.notify_one();
+                    return;
+                }
+            }
+            writable.await;
+        }
+    }
+
+    async fn pop(&self) -> Option<NovaEvent> {
+        loop {
+            let readable = self.readable.notified();
+            {
+                let mut state = self.lock();
+                if let Some(event) = state.events.pop_front() {
+                    drop(state);
+                    self.writable.notify_one();
+                    return Some(event);
+                }
+                if state.closed {
+                    return None;
+                }
+            }
+            readable.await;
+        }
+    }
+
+    fn close(&self) {
+        self.lock().closed = true;
+        self.readable.notify_waiters();
+        self.writable.notify_waiters();
+    }
+
+    fn detach(&self) {
+        self.lock().detached = true;
+        self.writable.notify_waiters();
+    }
+
+    fn is_detached(&self) -> bool {
+        self.lock().detached
+    }
 }
 
 /// Plugin event subscription info
@@ -78,6 +323,7 @@ pub struct PluginEventSubscription {
     pub plugin_id: String,
     pub filter: EventFilter,
     pub subscription_id: String,
+    queue: Arc<SubscriberQueue>,
 }
 
 /// Filter for events that a plugin wants to receive
@@ -88,6 +334,27 @@ pub struct EventFilter {
     pub include_user: bool,
 }
 
+impl EventFilter {
+    /// Check whether an event passes this filter
+    ///
+    /// Events published with [`SYSTEM_EVENT_SOURCE`] count as system events,
+    /// everything else as user events.
+    pub fn matches(&self, event: &NovaEvent) -> bool {
+        let type_matches = self
+            .event_types
+            .iter()
+            .any(|t| *t == EventType::All || *t == event.event_type);
+
+        let origin_matches = if event.source == SYSTEM_EVENT_SOURCE {
+            self.include_system
+        } else {
+            self.include_user
+        };
+
+        type_matches && origin_matches
+    }
+}
+
 impl Default for EventFilter {
     fn default() -> Self {
         Self {
@@ -160,7 +427,7 @@ impl NovaEvent {
     pub fn plugin_loaded(plugin_id: String) -> Self {
         Self::new(
             EventType::PluginLoaded,
-            "system".to_string(),
+            SYSTEM_EVENT_SOURCE.to_string(),
             serde_json::json!({ "plugin_id": plugin_id }),
         )
     }
@@ -184,7 +451,7 @@ mod tests {
         event_bus.publish(event.clone()).await.unwrap();
 
         // Receive the event
-        let received_event = subscription.receiver.recv().await.unwrap();
+        let received_event = subscription.recv().await.unwrap();
         assert_eq!(received_event.event_type, EventType::BackupStarted);
         assert_eq!(received_event.source, "test");
     }
@@ -202,4 +469,186 @@ mod tests {
 
         assert_eq!(event_bus.subscriber_count(), 2);
     }
+
+    #[tokio::test]
+    async fn test_lagging_subscriber_drops_oldest() {
+        let event_bus = EventBus::with_capacity(2);
+
+        let mut subscription = event_bus
+            .subscribe("slow-plugin".to_string(), EventFilter::default())
+            .await;
+
+        for i in 0..4 {
+            let event = NovaEvent::backup_started("test".to_string(), format!("backup{}", i));
+            event_bus.publish(event).await.unwrap();
+        }
+
+        // Only the two most recent events are still buffered, in order
+        let first = subscription.recv().await.unwrap();
+        let second = subscription.recv().await.unwrap();
+        assert_eq!(first.data["backup_id"], "backup2");
+        assert_eq!(second.data["backup_id"], "backup3");
+        assert_eq!(subscription.dropped_count(), 2);
+
+        drop(event_bus);
+        assert!(subscription.recv().await.is_none());
+    }
+
+    #[tokio::test]
+    async fn test_blocking_subscriber_applies_back_pressure() {
+        let event_bus = Arc::new(EventBus::new());
+
+        let options = SubscriptionOptions {
+            capacity: Some(1),
+            policy: DeliveryPolicy::Block,
+            ..Default::default()
+        };
+        let mut subscription = event_bus
+            .subscribe_with("sync-plugin".to_string(), EventFilter::default(), options)
+            .await;
+
+        event_bus
+            .publish(NovaEvent::backup_started("test".to_string(), "backup0".to_string()))
+            .await
+            .unwrap();
+
+        // The queue is full, so the next publish waits for the subscriber
+        let bus = event_bus.clone();
+        let publisher = tokio::spawn(async move {
+            bus.publish(NovaEvent::backup_started("test".to_string(), "backup1".to_string()))
+                .await
+        });
+        tokio::time::sleep(std::time::Duration::from_millis(50)).await;
+        assert!(!publisher.is_finished());
+
+        let first = subscription.recv().await.unwrap();
+        assert_eq!(first.data["backup_id"], "backup0");
+        publisher.await.unwrap().unwrap();
+
+        let second = subscription.recv().await.unwrap();
+        assert_eq!(second.data["backup_id"], "backup1");
+        assert_eq!(subscription.dropped_count(), 0);
+    }
+
+    #[tokio::test]
+    async fn test_coalesced_events_keep_latest() {
+        let event_bus = EventBus::new();
+
+        let options = SubscriptionOptions {
+            coalesce: vec![EventType::FileChanged],
+            ..Default::default()
+        };
+        let mut subscription = event_bus
+            .subscribe_with("ui".to_string(), EventFilter::default(), options)
+            .await;
+
+        let file_changed = |n: u32| {
+            NovaEvent::new(
+                EventType::FileChanged,
+                "test".to_string(),
+                serde_json::json!({ "files_done": n }),
+            )
+        };
+
+        event_bus.publish(file_changed(1)).await.unwrap();
+        event_bus.publish(file_changed(2)).await.unwrap();
+        event_bus
+            .publish(NovaEvent::backup_started("test".to_string(), "backup123".to_string()))
+            .await
+            .unwrap();
+        event_bus.publish(file_changed(3)).await.unwrap();
+
+        let first = subscription.recv().await.unwrap();
+        let second = subscription.recv().await.unwrap();
+        assert_eq!(first.event_type, EventType::BackupStarted);
+        assert_eq!(second.event_type, EventType::FileChanged);
+        assert_eq!(second.data["files_done"], 3);
+        assert_eq!(subscription.dropped_count(), 0);
+    }
+
+    #[tokio::test]
+    async fn test_dropped_subscription_is_removed() {
+        let event_bus = EventBus::new();
+
+        let subscription = event_bus
+            .subscribe("plugin1".to_string(), EventFilter::default())
+            .await;
+        assert_eq!(event_bus.subscriber_count(), 1);
+
+        drop(subscription);
+        assert_eq!(event_bus.subscriber_count(), 0);
+    }
+
+    #[tokio::test]
+    async fn test_subscription_filters_event_types() {
+        let event_bus = EventBus::new();
+
+        let filter = EventFilter {
+            event_types: vec![EventType::BackupCompleted],
+            include_system: true,
+            include_user: true,
+        };
+        let mut subscription = event_bus.subscribe("test-plugin".to_string(), filter).await;
+
+        event_bus
+            .publish(NovaEvent::backup_started("test".to_string(), "backup123".to_string()))
+            .await
+            .unwrap();
+        event_bus
+            .publish(NovaEvent::plugin_loaded("other-plugin".to_string()))
+            .await
+            .unwrap();
+        event_bus
+            .publish(NovaEvent::backup_completed("test".to_string(), "backup123".to_string(), 42))
+            .await
+            .unwrap();
+
+        let received_event = subscription.recv().await.unwrap();
+        assert_eq!(received_event.event_type, EventType::BackupCompleted);
+        assert_eq!(received_event.data["files_count"], 42);
+    }
+
+    #[tokio::test]
+    async fn test_filtered_subscriber_keeps_wanted_events_under_flood() {
+        let event_bus = EventBus::with_capacity(2);
+
+        let filter = EventFilter {
+            event_types: vec![EventType::BackupFailed],
+            include_system: true,
+            include_user: true,
+        };
+        let mut subscription = event_bus.subscribe("notifier".to_string(), filter).await;
+
+        event_bus
+            .publish(NovaEvent::new(
+                EventType::BackupFailed,
+                "test".to_string(),
+                serde_json::json!({ "backup_id": "backup123" }),
+            ))
+            .await
+            .unwrap();
+        for i in 0..10 {
+            let event = NovaEvent::backup_started("test".to_string(), format!("backup{}", i));
+            event_bus.publish(event).await.unwrap();
+        }
+
+        let received_event = subscription.recv().await.unwrap();
+        assert_eq!(received_event.event_type, EventType::BackupFailed);
+        assert_eq!(subscription.dropped_count(), 0);
+    }
+
+    #[test]
+    fn test_event_filter_origin() {
+        let user_only = EventFilter {
+            include_system: false,
+            ..Default::default()
+        };
+
+        let system_event = NovaEvent::plugin_loaded("test-plugin".to_string());
+        let user_event = NovaEvent::backup_started("test".to_string(), "backup123".to_string());
+
+        assert!(!user_only.matches(&system_event));
+        assert!(user_only.matches(&user_event));
+        assert!(EventFilter::default().matches(&system_event));
+    }
 }
\ No newline at end of file
@@ -0,0 +1,929 @@
+use crate::SecurityPolicy;
+use anyhow::{anyhow, Context};
+use serde::{Deserialize, Serialize};
+use std::io::{self, BufRead, BufReader, Read, Write};
+use std::path::PathBuf;
+use std::process::{Child, ChildStdin, ChildStdout, Command, Stdio};
+use std::sync::{Arc, Condvar, Mutex, PoisonError};
+use std::thread::JoinHandle;
+use std::time::{Duration, Instant};
+
+/// Error code reported for an item or object that doesn't exist
+pub const ERROR_NOT_FOUND: &str = "not_found";
+
+/// Request sent to an external plugin process
+///
+/// Written to the process stdin as a single JSON line, followed by
+/// `payload_len` raw bytes.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ExternalRequest {
+    pub method: String,
+    #[serde(default)]
+    pub params: serde_json::Value,
+    #[serde(default)]
+    pub payload_len: u64,
+}
+
+/// Response read back from an external plugin process
+///
+/// Read from the process stdout as a single JSON line, followed by
+/// `payload_len` raw bytes. Failed responses carry an `error` message and
+/// optionally an error `code` such as [`ERROR_NOT_FOUND`].
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ExternalResponse {
+    pub ok: bool,
+    #[serde(default)]
+    pub result: serde_json::Value,
+    #[serde(default)]
+    pub error: Option<String>,
+    #[serde(default)]
+    pub code: Option<String>,
+    #[serde(default)]
+    pub payload_len: u64,
+}
+
+/// Failure reported by an external plugin in its response
+#[derive(Debug, thiserror::Error)]
+#[error("External plugin {command:?} failed '{method}': {message}")]
+pub struct ExternalError {
+    pub command: PathBuf,
+    pub method: String,
+    pub code: Option<String>,
+    pub message: String,
+}
+
+impl ExternalError {
+    /// Whether the plugin reported that the requested item doesn't exist
+    pub fn is_not_found(&self) -> bool {
+        self.code.as_deref() == Some(ERROR_NOT_FOUND)
+    }
+}
+
+/// External plugin executable speaking the stdio protocol
+///
+/// External plugins run as ordinary processes outside the sandbox, so they can
+/// only be started when the [`SecurityPolicy`] allows dynamic loading. The
+/// policy's `max_execution_time_ms` bounds each wait on the process: for its
+/// response, or for the next bytes of a payload. A process that stalls longer
+/// is killed, while long transfers that keep moving are not.
+///
+/// Nothing confines the process itself, so policies that block capabilities or
+/// only trust some authors refuse to start it, and `max_memory_usage_mb` does
+/// not apply.
+///
+/// The process is started once and answers requests in a loop until its stdin
+/// is closed. It must read each request, including its payload, before
+/// answering. Calls are serialized over the single process; if one fails
+/// without a valid response, the process is restarted on the next call.
+#[derive(Debug)]
+pub struct ExternalProcess {
+    pub command: PathBuf,
+    pub args: Vec<String>,
+    kind: String,
+    timeout: Duration,
+    handshake: serde_json::Value,
+    session: Mutex<Option<Session>>,
+}
+
+/// Running plugin process with its protocol pipes
+#[derive(Debug)]
+struct Session {
+    child: Arc<Mutex<Child>>,
+    stdin: ChildStdin,
+    stdout: BufReader<ChildStdout>,
+    watchdog: Watchdog,
+}
+
+impl Session {
+    fn stop(self) {
+        let Session {
+            child, watchdog, ..
+        } = self;
+
+        // Stop the watchdog first, it must not signal the process group once
+        // the child is reaped
+        drop(watchdog);
+
+        let mut child = child.lock().unwrap_or_else(PoisonError::into_inner);
+        kill(&mut child);
+        let _ = child.wait();
+    }
+}
+
+/// Kills a plugin process when an armed deadline passes
+///
+/// Each session keeps a single watchdog thread that is armed for every
+/// request, rather than starting a thread per call.
+#[derive(Debug)]
+struct Watchdog {
+    shared: Arc<(Mutex<WatchdogState>, Condvar)>,
+    thread: Option<JoinHandle<()>>,
+}
+
+#[derive(Debug, Default)]
+struct WatchdogState {
+    deadline: Option<Instant>,
+    fired: bool,
+    stopped: bool,
+}
+
+impl Watchdog {
+    fn spawn(child: Arc<Mutex<Child>>) -> io::Result<Self> {
+        let shared = Arc::new((Mutex::new(WatchdogState::default()), Condvar::new()));
+
+        let thread = std::thread::Builder::new()
+            .name("plugin-watchdog".to_string())
+            .spawn({
+                let shared = shared.clone();
+                move || Self::run(&shared, &child)
+            })?;
+
+        Ok(Self {
+            shared,
+            thread: Some(thread),
+        })
+    }
+
+    fn run(shared: &(Mutex<WatchdogState>, Condvar), child: &Mutex<Child>) {
+        let (state, changed) = shared;
+        let mut state = state.lock().unwrap_or_else(PoisonError::into_inner);
+
+        while !state.stopped {
+            state = match state.deadline {
+                Some(deadline) if deadline <= Instant::now() => {
+                    state.deadline = None;
+                    state.fired = true;
+                    kill(&mut child.lock().unwrap_or_else(PoisonError::into_inner));
+                    state
+                }
+                Some(deadline) => {
+                    let remaining = deadline.saturating_duration_since(Instant::now());
+                    changed
+                        .wait_timeout(state, remaining)
+                        .unwrap_or_else(PoisonError::into_inner)
+                        .0
+                }
+                None => changed.wait(state).unwrap_or_else(PoisonError::into_inner),
+            };
+        }
+    }
+
+    /// Kill the process unless the watchdog is disarmed within `timeout`
+    fn arm(&self, timeout: Duration) {
+        let (state, changed) = &*self.shared;
+        state
+            .lock()
+            .unwrap_or_else(PoisonError::into_inner)
+            .deadline = Some(Instant::now() + timeout);
+        changed.notify_one();
+    }
+
+    /// Cancel the deadline
+    fn disarm(&self) {
+        let (state, _) = &*self.shared;
+        state
+            .lock()
+            .unwrap_or_else(PoisonError::into_inner)
+            .deadline = None;
+    }
+
+    /// Whether the watchdog has killed the process
+    fn fired(&self) -> bool {
+        let (state, _) = &*self.shared;
+        state.lock().unwrap_or_else(PoisonError::into_inner).fired
+    }
+}
+
+impl Drop for Watchdog {
+    fn drop(&mut self) {
+        let (state, changed) = &*self.shared;
+        state.lock().unwrap_or_else(PoisonError::into_inner).stopped = true;
+        changed.notify_one();
+
+        if let Some(thread) = self.thread.take() {
+            let _ = thread.join();
+        }
+    }
+}
+
+/// Plugin pipe whose blocking reads and writes are covered by the watchdog
+///
+/// Only the time spent waiting on the plugin counts against the deadline, not
+/// the time the caller takes to supply or consume payload bytes.
+struct Watched<'a, T> {
+    pipe: &'a mut T,
+    watchdog: &'a Watchdog,
+    timeout: Duration,
+}
+
+impl<T: Read> Read for Watched<'_, T> {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        self.watchdog.arm(self.timeout);
+        let result = self.pipe.read(buf);
+        self.watchdog.disarm();
+        result
+    }
+}
+
+impl<T: BufRead> BufRead for Watched<'_, T> {
+    fn fill_buf(&mut self) -> io::Result<&[u8]> {
+        self.watchdog.arm(self.timeout);
+        let result = self.pipe.fill_buf();
+        self.watchdog.disarm();
+        result
+    }
+
+    fn consume(&mut self, amount: usize) {
+        self.pipe.consume(amount);
+    }
+}
+
+impl<T: Write> Write for Watched<'_, T> {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        self.watchdog.arm(self.timeout);
+        let result = self.pipe.write(buf);
+        self.watchdog.disarm();
+        result
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.watchdog.arm(self.timeout);
+        let result = self.pipe.flush();
+        self.watchdog.disarm();
+        result
+    }
+}
+
+impl ExternalProcess {
+    /// Start an external plugin of the given kind, if allowed by `policy`
+    ///
+    /// Fails when the policy asks for restrictions an unsandboxed process can't
+    /// be held to, or unless the process completes the handshake for `kind`
+    /// with the current plugin API version.
+    pub fn start(
+        command: impl Into<PathBuf>,
+        args: Vec<String>,
+        kind: &str,
+        policy: &SecurityPolicy,
+    ) -> crate::PluginResult<Self> {
+        let command = command.into();
+
+        if !policy.allow_dynamic_loading {
+            anyhow::bail!(
+                "Loading external plugin {:?} is not allowed by the security policy",
+                command
+            );
+        }
+
+        if policy.require_signature_verification {
+            anyhow::bail!(
+                "External plugin {:?} can't be loaded: the security policy requires signature \
+                 verification, which is not supported for external plugins yet",
+                command
+            );
+        }
+
+        if !policy.trusted_authors.is_empty() {
+            anyhow::bail!(
+                "External plugin {:?} can't be loaded: the security policy only trusts some \
+                 authors, and external plugins carry no verifiable author",
+                command
+            );
+        }
+
+        if !policy.blocked_capabilities.is_empty() {
+            anyhow::bail!(
+                "External plugin {:?} can't be loaded: the security policy blocks capabilities \
+                 ({}) that can't be enforced on a process outside the sandbox",
+                command,
+                policy.blocked_capabilities.join(", ")
+            );
+        }
+
+        let mut process = Self {
+            command,
+            args,
+            kind: kind.to_string(),
+            timeout: Duration::from_millis(policy.max_execution_time_ms),
+            handshake: serde_json::Value::Null,
+            session: Mutex::new(None),
+        };
+
+        let (session, handshake) = process.spawn()?;
+        process.handshake = handshake;
+        process.session = Mutex::new(Some(session));
+        Ok(process)
+    }
+
+    /// Handshake result reported by the process when it was started
+    pub fn handshake(&self) -> &serde_json::Value {
+        &self.handshake
+    }
+
+    /// Call a method without payloads, returning its result
+    pub fn request(
+        &self,
+        method: &str,
+        params: serde_json::Value,
+    ) -> crate::PluginResult<serde_json::Value> {
+        let (result, _) = self.call(method, params, &mut io::empty(), 0, &mut io::sink())?;
+        Ok(result)
+    }
+
+    /// Call a method on the external process
+    ///
+    /// Streams `input_len` bytes from `input` to the process and its response
+    /// payload into `output`, returning the result and the payload size.
+    /// Failures reported by the plugin are returned as [`ExternalError`].
+    pub fn call(
+        &self,
+        method: &str,
+        params: serde_json::Value,
+        input: &mut dyn Read,
+        input_len: u64,
+        output: &mut dyn Write,
+    ) -> crate::PluginResult<(serde_json::Value, u64)> {
+        let mut session = self.session.lock().unwrap_or_else(PoisonError::into_inner);
+
+        let running = match session.take() {
+            Some(running) => running,
+            None => {
+                tracing::warn!("Restarting external plugin {:?}", self.command);
+                self.spawn()?.0
+            }
+        };
+        let running = session.insert(running);
+
+        let result = self.exchange(running, method, params, input, input_len, output);
+
+        // Anything but a failure reported by the plugin leaves the protocol
+        // out of step, and a process killed by the watchdog is gone even if
+        // it answered just in time, so neither can take further requests
+        let broken = match &result {
+            Ok(_) => running.watchdog.fired(),
+            Err(e) => e.downcast_ref::<ExternalError>().is_none() || running.watchdog.fired(),
+        };
+        if broken {
+            if let Some(running) = session.take() {
+                running.stop();
+            }
+        }
+
+        result
+    }
+
+    fn spawn(&self) -> crate::PluginResult<(Session, serde_json::Value)> {
+        let mut command = Command::new(&self.command);
+        command
+            .args(&self.args)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::inherit());
+
+        // Give the plugin its own process group so that killing it also
+        // stops anything it started
+        #[cfg(unix)]
+        std::os::unix::process::CommandExt::process_group(&mut command, 0);
+
+        let mut child = command
+            .spawn()
+            .with_context(|| format!("Failed to start external plugin {:?}", self.command))?;
+
+        let (stdin, stdout) = match (child.stdin.take(), child.stdout.take()) {
+            (Some(stdin), Some(stdout)) => (stdin, stdout),
+            _ => {
+                kill(&mut child);
+                let _ = child.wait();
+                anyhow::bail!("Failed to open pipes of {:?}", self.command);
+            }
+        };
+
+        let child = Arc::new(Mutex::new(child));
+        let watchdog = match Watchdog::spawn(child.clone()) {
+            Ok(watchdog) => watchdog,
+            Err(e) => {
+                let mut child = child.lock().unwrap_or_else(PoisonError::into_inner);
+                kill(&mut child);
+                let _ = child.wait();
+                return Err(anyhow!(
+                    "Failed to watch external plugin {:?}: {}",
+                    self.command,
+                    e
+                ));
+            }
+        };
+
+        let mut session = Session {
+            child,
+            stdin,
+            stdout: BufReader::new(stdout),
+            watchdog,
+        };
+
+        let handshake = self
+            .exchange(
+                &mut session,
+                "handshake",
+                serde_json::json!({
+                    "api_version": crate::CURRENT_API_VERSION,
+                    "kind": self.kind,
+                }),
+                &mut io::empty(),
+                0,
+                &mut io::sink(),
+            )
+            .and_then(|(result, _)| self.check_handshake(result));
+
+        match handshake {
+            Ok(handshake) if !session.watchdog.fired() => Ok((session, handshake)),
+            Ok(_) => {
+                session.stop();
+                anyhow::bail!(
+                    "External plugin {:?} was killed at its deadline during the handshake",
+                    self.command
+                );
+            }
+            Err(e) => {
+                session.stop();
+                Err(e)
+            }
+        }
+    }
+
+    fn check_handshake(&self, result: serde_json::Value) -> crate::PluginResult<serde_json::Value> {
+        let api_version = result
+            .get("api_version")
+            .and_then(|v| v.as_u64())
+            .ok_or_else(|| anyhow!("{:?} handshake did not report an API version", self.command))?;
+
+        if api_version != crate::CURRENT_API_VERSION as u64 {
+            anyhow::bail!(
+                "External plugin {:?} requires API version {}, but current version is {}",
+                self.command,
+                api_version,
+                crate::CURRENT_API_VERSION
+            );
+        }
+
+        let kind = result.get("kind").and_then(|v| v.as_str());
+        if kind != Some(self.kind.as_str()) {
+            anyhow::bail!(
+                "External plugin {:?} is not a {} plugin (handshake reported kind {:?})",
+                self.command,
+                self.kind,
+                kind
+            );
+        }
+
+        Ok(result)
+    }
+
+    fn exchange(
+        &self,
+        session: &mut Session,
+        method: &str,
+        params: serde_json::Value,
+        input: &mut dyn Read,
+        input_len: u64,
+        output: &mut dyn Write,
+    ) -> crate::PluginResult<(serde_json::Value, u64)> {
+        let request = ExternalRequest {
+            method: method.to_string(),
+            params,
+            payload_len: input_len,
+        };
+        let mut header = serde_json::to_vec(&request)?;
+        header.push(b'\n');
+
+        let Session {
+            stdin,
+            stdout,
+            watchdog,
+            ..
+        } = session;
+
+        let mut stdin = Watched {
+            pipe: stdin,
+            watchdog,
+            timeout: self.timeout,
+        };
+        let mut stdout = Watched {
+            pipe: stdout,
+            watchdog,
+            timeout: self.timeout,
+        };
+
+        let response = self
+            .send_request(&mut stdin, &header, method, input, input_len)
+            .and_then(|_| self.read_response(&mut stdout, method, output));
+
+        match response {
+            Ok(response) => {
+                if watchdog.fired() {
+                    tracing::warn!(
+                        "External plugin {:?} answered '{}' as it was killed at its deadline",
+                        self.command,
+                        method
+                    );
+                }
+                Ok((response.result, response.payload_len))
+            }
+            Err(_) if watchdog.fired() => anyhow::bail!(
+                "External plugin {:?} stalled for {:?} during '{}' and was killed",
+                self.command,
+                self.timeout,
+                method
+            ),
+            Err(e) => Err(e),
+        }
+    }
+
+    fn send_request(
+        &self,
+        stdin: &mut impl Write,
+        header: &[u8],
+        method: &str,
+        input: &mut dyn Read,
+        input_len: u64,
+    ) -> crate::PluginResult<()> {
+        stdin.write_all(header)?;
+
+        let sent = io::copy(&mut input.take(input_len), stdin)?;
+        if sent != input_len {
+            anyhow::bail!(
+                "Request payload for '{}' ended after {} of {} bytes",
+                method,
+                sent,
+                input_len
+            );
+        }
+
+        stdin.flush()?;
+        Ok(())
+    }
+
+    fn read_response(
+        &self,
+        stdout: &mut impl BufRead,
+        method: &str,
+        output: &mut dyn Write,
+    ) -> crate::PluginResult<ExternalResponse> {
+        let mut header = String::new();
+        if stdout.read_line(&mut header)? == 0 {
+            anyhow::bail!(
+                "External plugin {:?} exited without answering '{}'",
+                self.command,
+                method
+            );
+        }
+
+        let response: ExternalResponse = serde_json::from_str(&header).with_context(|| {
+            format!("Invalid response from {:?} for '{}'", self.command, method)
+        })?;
+
+        if !response.ok {
+            if response.payload_len > 0 {
+                anyhow::bail!(
+                    "External plugin {:?} sent a payload with its error for '{}'",
+                    self.command,
+                    method
+                );
+            }
+
+            return Err(ExternalError {
+                command: self.command.clone(),
+                method: method.to_string(),
+                code: response.code,
+                message: response
+                    .error
+                    .unwrap_or_else(|| "unknown error".to_string()),
+            }
+            .into());
+        }
+
+        let received = io::copy(&mut stdout.take(response.payload_len), output)?;
+        if received != response.payload_len {
+            anyhow::bail!(
+                "External plugin {:?} sent {} payload bytes for '{}', expected {}",
+                self.command,
+                received,
+                method,
+                response.payload_len
+            );
+        }
+
+        Ok(response)
+    }
+}
+
+impl Drop for ExternalProcess {
+    fn drop(&mut self) {
+        let session = self
+            .session
+            .get_mut()
+            .unwrap_or_else(PoisonError::into_inner);
+        if let Some(session) = session.take() {
+            session.stop();
+        }
+    }
+}
+
+/// Kill a plugin process along with its process group
+///
+/// Processes started by the plugin may still hold its stdout open, which would
+/// keep a pending read blocked after the plugin itself is gone.
+fn kill(child: &mut Child) {
+    #[cfg(unix)]
+    unsafe {
+        // Safe to signal: the child is not reaped yet, so its group id is
+        // still ours
+        libc::kill(-(child.id() as libc::pid_t), libc::SIGKILL);
+    }
+
+    let _ = child.kill();
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+
+    fn policy() -> SecurityPolicy {
+        SecurityPolicy {
+            allow_dynamic_loading: true,
+            require_signature_verification: false,
+            blocked_capabilities: vec![],
+            max_execution_time_ms: 5000,
+            ..Default::default()
+        }
+    }
+
+    /// Start a shell plugin that answers the handshake and then runs `body`
+    /// for each request line in `$line`
+    fn script(body: &str) -> ExternalProcess {
+        start_script(body, &policy())
+    }
+
+    fn start_script(body: &str, policy: &SecurityPolicy) -> ExternalProcess {
+        try_start_script(
+            r#"{"ok":true,"result":{"api_version":1,"kind":"test"}}"#,
+            body,
+            policy,
+        )
+        .unwrap()
+    }
+
+    fn try_start_script(
+        handshake: &str,
+        body: &str,
+        policy: &SecurityPolicy,
+    ) -> crate::PluginResult<ExternalProcess> {
+        let responder = format!(
+            "read line; printf '%s\\n' '{}'\nwhile read line; do\n{}\ndone",
+            handshake, body
+        );
+        ExternalProcess::start("sh", vec!["-c".to_string(), responder], "test", policy)
+    }
+
+    #[test]
+    fn test_security_policy_blocks_loading() {
+        let handshake = r#"{"ok":true,"result":{"api_version":1,"kind":"test"}}"#;
+
+        let error = try_start_script(handshake, "true", &SecurityPolicy::default())
+            .unwrap_err()
+            .to_string();
+        assert!(error.contains("not allowed by the security policy"));
+
+        let signed_only = SecurityPolicy {
+            allow_dynamic_loading: true,
+            ..Default::default()
+        };
+        let error = try_start_script(handshake, "true", &signed_only)
+            .unwrap_err()
+            .to_string();
+        assert!(error.contains("signature verification"));
+
+        let trusted_only = SecurityPolicy {
+            trusted_authors: vec!["NovaPcSuite".to_string()],
+            ..policy()
+        };
+        let error = try_start_script(handshake, "true", &trusted_only)
+            .unwrap_err()
+            .to_string();
+        assert!(error.contains("only trusts some authors"));
+
+        let no_network = SecurityPolicy {
+            blocked_capabilities: vec!["network".to_string()],
+            ..policy()
+        };
+        let error = try_start_script(handshake, "true", &no_network)
+            .unwrap_err()
+            .to_string();
+        assert!(error.contains("blocks capabilities (network)"));
+    }
+
+    #[test]
+    fn test_handshake() {
+        let process = script("true");
+        assert_eq!(process.handshake()["api_version"], 1);
+    }
+
+    #[test]
+    fn test_handshake_rejects_api_version() {
+        let error = try_start_script(
+            r#"{"ok":true,"result":{"api_version":999,"kind":"test"}}"#,
+            "true",
+            &policy(),
+        )
+        .unwrap_err()
+        .to_string();
+        assert!(error.contains("requires API version 999"));
+    }
+
+    #[test]
+    fn test_handshake_rejects_kind() {
+        let error = try_start_script(
+            r#"{"ok":true,"result":{"api_version":1}}"#,
+            "true",
+            &policy(),
+        )
+        .unwrap_err()
+        .to_string();
+        assert!(error.contains("is not a test plugin"));
+
+        let error = try_start_script(
+            r#"{"ok":true,"result":{"api_version":1,"kind":"storage"}}"#,
+            "true",
+            &policy(),
+        )
+        .unwrap_err()
+        .to_string();
+        assert!(error.contains("is not a test plugin"));
+    }
+
+    #[test]
+    fn test_call_payload_roundtrip() {
+        // Echo each request payload back after the response line
+        let process = script(
+            r#"len=${line##*\"payload_len\":}; len=${len%\}}
+printf '{"ok":true,"payload_len":%d}\n' "$len"
+dd bs=1 count="$len" 2>/dev/null"#,
+        );
+
+        for data in [&b"hello"[..], &b"second request"[..]] {
+            let mut output = Vec::new();
+            let (_, received) = process
+                .call(
+                    "echo",
+                    serde_json::Value::Null,
+                    &mut &data[..],
+                    data.len() as u64,
+                    &mut output,
+                )
+                .unwrap();
+            assert_eq!(received, data.len() as u64);
+            assert_eq!(output, data);
+        }
+    }
+
+    #[test]
+    fn test_process_serves_requests_in_one_session() {
+        let process = script(r#"printf '{"ok":true,"result":%d}\n' $$"#);
+
+        let first = process.request("pid", serde_json::Value::Null).unwrap();
+        let second = process.request("pid", serde_json::Value::Null).unwrap();
+        assert_eq!(first, second);
+    }
+
+    #[test]
+    fn test_call_error_response() {
+        let process =
+            script(r#"printf '{"ok":false,"error":"no such item","code":"not_found"}\n'"#);
+
+        let error = process
+            .request("fail", serde_json::Value::Null)
+            .unwrap_err();
+        let external = error.downcast_ref::<ExternalError>().unwrap();
+        assert!(external.is_not_found());
+        assert!(error.to_string().contains("no such item"));
+
+        // A failure reported by the plugin keeps the session usable
+        assert!(process.request("fail", serde_json::Value::Null).is_err());
+    }
+
+    /// Caller-side payload endpoint that takes its time with every chunk
+    struct Slow(Vec<u8>);
+
+    impl Read for Slow {
+        fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+            std::thread::sleep(Duration::from_millis(150));
+            let len = buf.len().min(self.0.len()).min(1);
+            buf[..len].copy_from_slice(&self.0[..len]);
+            self.0.drain(..len);
+            Ok(len)
+        }
+    }
+
+    impl Write for Slow {
+        fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+            std::thread::sleep(Duration::from_millis(150));
+            self.0.extend_from_slice(buf);
+            Ok(buf.len())
+        }
+
+        fn flush(&mut self) -> io::Result<()> {
+            Ok(())
+        }
+    }
+
+    #[test]
+    fn test_deadline_does_not_cover_whole_transfer() {
+        let policy = SecurityPolicy {
+            max_execution_time_ms: 300,
+            ..policy()
+        };
+        // Trickle the response payload, and read the request payload as it
+        // comes, each over longer than the deadline
+        let process = start_script(
+            r#"case "$line" in
+  *'"fetch"'*) printf '{"ok":true,"payload_len":4}\n'
+    for chunk in a b c d; do sleep 0.15; printf $chunk; done ;;
+  *) dd bs=1 count=4 of=/dev/null 2>/dev/null; printf '{"ok":true}\n' ;;
+esac"#,
+            &policy,
+        );
+
+        let started = std::time::Instant::now();
+        let mut output = Slow(Vec::new());
+        let (_, received) = process
+            .call(
+                "fetch",
+                serde_json::Value::Null,
+                &mut io::empty(),
+                0,
+                &mut output,
+            )
+            .unwrap();
+        assert_eq!(received, 4);
+        assert_eq!(output.0, b"abcd");
+
+        let mut input = Slow(b"data".to_vec());
+        process
+            .call(
+                "restore",
+                serde_json::Value::Null,
+                &mut input,
+                4,
+                &mut io::sink(),
+            )
+            .unwrap();
+
+        assert!(started.elapsed() > Duration::from_millis(600));
+    }
+
+    #[test]
+    fn test_late_watchdog_keeps_completed_result() {
+        let process = script(r#"printf '{"ok":true,"result":%d}\n' $$"#);
+        let first = process.request("pid", serde_json::Value::Null).unwrap();
+
+        // Simulate the watchdog firing just as the plugin answers
+        {
+            let session = process.session.lock().unwrap();
+            let (state, _) = &*session.as_ref().unwrap().watchdog.shared;
+            state.lock().unwrap().fired = true;
+        }
+
+        let answered = process.request("pid", serde_json::Value::Null).unwrap();
+        assert_eq!(answered, first);
+
+        // The session is replaced for the next call
+        let restarted = process.request("pid", serde_json::Value::Null).unwrap();
+        assert_ne!(restarted, first);
+    }
+
+    #[test]
+    fn test_call_kills_process_after_deadline() {
+        let policy = SecurityPolicy {
+            max_execution_time_ms: 200,
+            ..policy()
+        };
+        let process = start_script(
+            r#"case "$line" in
+  *'"hang"'*) sleep 10 ;;
+  *) printf '{"ok":true,"result":"pong"}\n' ;;
+esac"#,
+            &policy,
+        );
+
+        let started = std::time::Instant::now();
+        let error = process
+            .request("hang", serde_json::Value::Null)
+            .unwrap_err()
+            .to_string();
+        assert!(error.contains("during 'hang'"));
+        assert!(started.elapsed() < Duration::from_secs(5));
+
+        // The killed plugin is restarted for the next call
+        let result = process.request("ping", serde_json::Value::Null).unwrap();
+        assert_eq!(result, "pong");
+    }
+}
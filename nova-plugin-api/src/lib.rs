@@ -3,12 +3,18 @@ pub mod registry;
 pub mod events;
 pub mod config;
 pub mod sandbox;
+pub mod external;
+pub mod provider;
+pub mod storage;
 
 pub use descriptor::*;
 pub use registry::*;
 pub use events::*;
 pub use config::*;
 pub use sandbox::*;
+pub use external::*;
+pub use provider::*;
+pub use storage::*;
 
 use anyhow::Result;
 use serde::{Deserialize, Serialize};
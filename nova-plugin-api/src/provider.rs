@@ -0,0 +1,181 @@
+use crate::{ExternalProcess, PluginResult, SecurityPolicy};
+use serde::{Deserialize, Serialize};
+use std::io::{Read, Write};
+use std::path::PathBuf;
+
+/// Data domains that a provider can back up and restore
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq, Eq)]
+pub enum DataDomain {
+    #[serde(rename = "contacts")]
+    Contacts,
+    #[serde(rename = "messages")]
+    Messages,
+    #[serde(rename = "call_logs")]
+    CallLogs,
+    #[serde(rename = "apps")]
+    Apps,
+    #[serde(rename = "whatsapp")]
+    WhatsApp,
+    #[serde(rename = "media")]
+    Media,
+}
+
+/// A single item discovered by a provider scan
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ProviderItem {
+    pub id: String,
+    pub name: String,
+    pub size: u64,
+    pub modified: Option<chrono::DateTime<chrono::Utc>>,
+    #[serde(default)]
+    pub metadata: serde_json::Value,
+}
+
+/// Provider of a data domain (contacts, SMS, apps, ...)
+///
+/// Calls may block on device or process I/O, so async callers should run them
+/// with `tokio::task::spawn_blocking`. Item content is streamed rather than
+/// buffered, since media items can be larger than available memory.
+pub trait DataProvider: Send + Sync {
+    /// Data domain handled by this provider
+    fn domain(&self) -> DataDomain;
+
+    /// List the items currently available for backup
+    fn scan(&self) -> PluginResult<Vec<ProviderItem>>;
+
+    /// Write the content of a scanned item to `output`, returning its size
+    fn fetch(&self, item: &ProviderItem, output: &mut dyn Write) -> PluginResult<u64>;
+
+    /// Restore an item from `len` bytes of previously fetched content
+    fn restore(&self, item: &ProviderItem, input: &mut dyn Read, len: u64) -> PluginResult<()>;
+}
+
+/// Data provider implemented by an external executable
+///
+/// The executable answers `handshake`, `scan`, `fetch` and `restore` requests
+/// over the stdio protocol described in [`ExternalProcess`].
+#[derive(Debug)]
+pub struct ExternalProvider {
+    process: ExternalProcess,
+    domain: DataDomain,
+}
+
+impl ExternalProvider {
+    /// Start the provider executable and check it with a handshake
+    pub fn load(
+        command: impl Into<PathBuf>,
+        args: Vec<String>,
+        policy: &SecurityPolicy,
+    ) -> PluginResult<Self> {
+        let process = ExternalProcess::start(command, args, "provider", policy)?;
+
+        let domain = serde_json::from_value(
+            process
+                .handshake()
+                .get("domain")
+                .cloned()
+                .unwrap_or_default(),
+        )
+        .map_err(|e| {
+            anyhow::anyhow!(
+                "{:?} reported an invalid data domain: {}",
+                process.command,
+                e
+            )
+        })?;
+
+        tracing::info!(
+            "Loaded external provider {:?} for {:?}",
+            process.command,
+            domain
+        );
+        Ok(Self { process, domain })
+    }
+}
+
+impl DataProvider for ExternalProvider {
+    fn domain(&self) -> DataDomain {
+        self.domain.clone()
+    }
+
+    fn scan(&self) -> PluginResult<Vec<ProviderItem>> {
+        let result = self.process.request("scan", serde_json::Value::Null)?;
+        Ok(serde_json::from_value(result)?)
+    }
+
+    fn fetch(&self, item: &ProviderItem, output: &mut dyn Write) -> PluginResult<u64> {
+        let (_, size) = self.process.call(
+            "fetch",
+            serde_json::to_value(item)?,
+            &mut std::io::empty(),
+            0,
+            output,
+        )?;
+        Ok(size)
+    }
+
+    fn restore(&self, item: &ProviderItem, input: &mut dyn Read, len: u64) -> PluginResult<()> {
+        self.process.call(
+            "restore",
+            serde_json::to_value(item)?,
+            input,
+            len,
+            &mut std::io::sink(),
+        )?;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_provider_item_serialization() {
+        let item = ProviderItem {
+            id: "contact-1".to_string(),
+            name: "Mario Rossi".to_string(),
+            size: 128,
+            modified: None,
+            metadata: serde_json::json!({ "format": "vcf" }),
+        };
+
+        let json = serde_json::to_value(&item).unwrap();
+        let parsed: ProviderItem = serde_json::from_value(json).unwrap();
+        assert_eq!(parsed.id, "contact-1");
+        assert_eq!(parsed.metadata["format"], "vcf");
+
+        let domain: DataDomain = serde_json::from_str("\"call_logs\"").unwrap();
+        assert_eq!(domain, DataDomain::CallLogs);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_external_provider() {
+        let responder = r#"while read line; do
+case "$line" in
+  *'"handshake"'*) printf '{"ok":true,"result":{"api_version":1,"kind":"provider","domain":"contacts"}}\n' ;;
+  *'"scan"'*) printf '{"ok":true,"result":[{"id":"c1","name":"Mario","size":3,"modified":null}]}\n' ;;
+  *'"fetch"'*) printf '{"ok":true,"payload_len":3}\nvcf' ;;
+esac
+done"#;
+        let policy = SecurityPolicy {
+            allow_dynamic_loading: true,
+            require_signature_verification: false,
+            blocked_capabilities: vec![],
+            ..Default::default()
+        };
+        let provider =
+            ExternalProvider::load("sh", vec!["-c".to_string(), responder.to_string()], &policy)
+                .unwrap();
+        assert_eq!(provider.domain(), DataDomain::Contacts);
+
+        let items = provider.scan().unwrap();
+        assert_eq!(items.len(), 1);
+        assert_eq!(items[0].name, "Mario");
+
+        let mut data = Vec::new();
+        assert_eq!(provider.fetch(&items[0], &mut data).unwrap(), 3);
+        assert_eq!(data, b"vcf");
+    }
+}
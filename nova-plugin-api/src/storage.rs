@@ -0,0 +1,198 @@
+use crate::{ExternalError, ExternalProcess, PluginResult, SecurityPolicy};
+use std::path::PathBuf;
+
+/// Storage backend for backup objects, addressed by key
+///
+/// Calls may block on disk, network or process I/O. Operations on a missing
+/// key fail with [`ObjectNotFound`], see [`is_object_not_found`].
+pub trait StorageBackend: Send + Sync {
+    /// Backend name used in logs and configuration
+    fn name(&self) -> &str;
+
+    /// Store an object, replacing any existing object with the same key
+    fn put(&self, key: &str, data: &[u8]) -> PluginResult<()>;
+
+    /// Read an object
+    fn get(&self, key: &str) -> PluginResult<Vec<u8>>;
+
+    /// Check whether an object exists
+    fn exists(&self, key: &str) -> PluginResult<bool>;
+
+    /// Delete an object
+    fn delete(&self, key: &str) -> PluginResult<()>;
+
+    /// List object keys starting with `prefix`
+    fn list(&self, prefix: &str) -> PluginResult<Vec<String>>;
+}
+
+/// Error returned by storage backends for a key that doesn't exist
+#[derive(Debug, thiserror::Error)]
+#[error("Object {0} not found")]
+pub struct ObjectNotFound(pub String);
+
+/// Check whether a storage error means the object doesn't exist
+pub fn is_object_not_found(error: &anyhow::Error) -> bool {
+    error.downcast_ref::<ObjectNotFound>().is_some()
+}
+
+/// Storage backend implemented by an external executable
+///
+/// The executable answers `put`, `get`, `exists`, `delete` and `list`
+/// requests over the stdio protocol described in [`ExternalProcess`], and
+/// reports missing keys with the `not_found` error code.
+#[derive(Debug)]
+pub struct ExternalBackend {
+    process: ExternalProcess,
+    name: String,
+}
+
+impl ExternalBackend {
+    /// Start the backend executable and check it with a handshake
+    pub fn load(
+        command: impl Into<PathBuf>,
+        args: Vec<String>,
+        policy: &SecurityPolicy,
+    ) -> PluginResult<Self> {
+        let process = ExternalProcess::start(command, args, "storage", policy)?;
+
+        let name = process
+            .handshake()
+            .get("name")
+            .and_then(|v| v.as_str())
+            .map(str::to_string)
+            .unwrap_or_else(|| process.command.display().to_string());
+
+        tracing::info!("Loaded external storage backend {}", name);
+        Ok(Self { process, name })
+    }
+}
+
+/// Turn a `not_found` failure from the backend into [`ObjectNotFound`]
+fn not_found(key: &str, error: anyhow::Error) -> anyhow::Error {
+    match error.downcast_ref::<ExternalError>() {
+        Some(external) if external.is_not_found() => ObjectNotFound(key.to_string()).into(),
+        _ => error,
+    }
+}
+
+impl StorageBackend for ExternalBackend {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn put(&self, key: &str, data: &[u8]) -> PluginResult<()> {
+        let mut input = data;
+        self.process.call(
+            "put",
+            serde_json::json!({ "key": key }),
+            &mut input,
+            data.len() as u64,
+            &mut std::io::sink(),
+        )?;
+        Ok(())
+    }
+
+    fn get(&self, key: &str) -> PluginResult<Vec<u8>> {
+        let mut data = Vec::new();
+        self.process
+            .call(
+                "get",
+                serde_json::json!({ "key": key }),
+                &mut std::io::empty(),
+                0,
+                &mut data,
+            )
+            .map_err(|e| not_found(key, e))?;
+        Ok(data)
+    }
+
+    fn exists(&self, key: &str) -> PluginResult<bool> {
+        let result = self
+            .process
+            .request("exists", serde_json::json!({ "key": key }))?;
+        result.as_bool().ok_or_else(|| {
+            anyhow::anyhow!("Backend {} returned a non-boolean for exists", self.name)
+        })
+    }
+
+    fn delete(&self, key: &str) -> PluginResult<()> {
+        self.process
+            .request("delete", serde_json::json!({ "key": key }))
+            .map_err(|e| not_found(key, e))?;
+        Ok(())
+    }
+
+    fn list(&self, prefix: &str) -> PluginResult<Vec<String>> {
+        let result = self
+            .process
+            .request("list", serde_json::json!({ "prefix": prefix }))?;
+        Ok(serde_json::from_value(result)?)
+    }
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+
+    fn policy() -> SecurityPolicy {
+        SecurityPolicy {
+            allow_dynamic_loading: true,
+            require_signature_verification: false,
+            blocked_capabilities: vec![],
+            ..Default::default()
+        }
+    }
+
+    fn load(responder: String) -> PluginResult<ExternalBackend> {
+        ExternalBackend::load("sh", vec!["-c".to_string(), responder], &policy())
+    }
+
+    #[test]
+    fn test_external_backend() {
+        let temp_dir = tempfile::TempDir::new().unwrap();
+        let store = temp_dir.path().join("object");
+
+        // Single-object store kept in a file next to the test
+        let responder = format!(
+            r#"missing='{{"ok":false,"error":"no object","code":"not_found"}}'
+while read line; do
+case "$line" in
+  *'"handshake"'*) printf '{{"ok":true,"result":{{"api_version":1,"kind":"storage","name":"tape"}}}}\n' ;;
+  *'"put"'*) len=${{line##*\"payload_len\":}}; len=${{len%\}}}}
+    dd bs=1 count="$len" of='{store}' 2>/dev/null; printf '{{"ok":true}}\n' ;;
+  *'"get"'*) if [ -f '{store}' ]; then
+      printf '{{"ok":true,"payload_len":%d}}\n' $(wc -c < '{store}'); cat '{store}'
+    else printf '%s\n' "$missing"; fi ;;
+  *'"exists"'*) if [ -f '{store}' ]; then r=true; else r=false; fi; printf '{{"ok":true,"result":%s}}\n' $r ;;
+  *'"delete"'*) if rm '{store}' 2>/dev/null; then printf '{{"ok":true}}\n'; else printf '%s\n' "$missing"; fi ;;
+  *'"list"'*) printf '{{"ok":true,"result":["object"]}}\n' ;;
+esac
+done"#,
+            store = store.display()
+        );
+
+        let backend = load(responder).unwrap();
+        assert_eq!(backend.name(), "tape");
+
+        assert!(!backend.exists("object").unwrap());
+        assert!(is_object_not_found(&backend.get("object").unwrap_err()));
+
+        backend.put("object", b"chunk data").unwrap();
+        assert!(backend.exists("object").unwrap());
+        assert_eq!(backend.get("object").unwrap(), b"chunk data");
+        assert_eq!(backend.list("").unwrap(), vec!["object".to_string()]);
+
+        backend.delete("object").unwrap();
+        assert!(!backend.exists("object").unwrap());
+        assert!(is_object_not_found(&backend.delete("object").unwrap_err()));
+    }
+
+    #[test]
+    fn test_external_backend_requires_storage_kind() {
+        let responder = r#"read line
+printf '{"ok":true,"result":{"api_version":1,"kind":"provider"}}\n'"#;
+
+        let error = load(responder.to_string()).unwrap_err().to_string();
+        assert!(error.contains("is not a storage plugin"));
+    }
+}